@@ -0,0 +1,44 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"io/fs"
+	"path"
+)
+
+// Backend is the remote storage tier a [Server] faults cache objects in and
+// out of beyond its local disk cache. Implementations must be safe for
+// concurrent use by multiple goroutines.
+type Backend interface {
+	// Get returns the object stored under hash. If no such object exists,
+	// the returned error must satisfy [errors.Is](err, [fs.ErrNotExist]).
+	Get(ctx context.Context, hash string) ([]byte, error)
+
+	// Put stores data under hash, replacing any existing object.
+	Put(ctx context.Context, hash string, data []byte) error
+
+	// Stat reports whether an object is stored under hash.
+	Stat(ctx context.Context, hash string) (bool, error)
+
+	// Delete removes the object stored under hash, if any. It is not an
+	// error to delete an object that does not exist.
+	Delete(ctx context.Context, hash string) error
+}
+
+// objectKey returns the storage key for hash under the given prefix, using
+// the same sharded layout as the local disk cache.
+func objectKey(prefix, hash string) string { return path.Join(prefix, hash[:2], hash) }
+
+// NoRemoteBackend is a [Backend] with no remote tier at all. Every Get misses
+// and every Put is silently discarded. It is useful for airgapped
+// deployments that want only the local disk cache a [Server] already
+// maintains, without talking to any remote store.
+type NoRemoteBackend struct{}
+
+func (NoRemoteBackend) Get(context.Context, string) ([]byte, error) { return nil, fs.ErrNotExist }
+func (NoRemoteBackend) Put(context.Context, string, []byte) error   { return nil }
+func (NoRemoteBackend) Stat(context.Context, string) (bool, error)  { return false, nil }
+func (NoRemoteBackend) Delete(context.Context, string) error        { return nil }
@@ -0,0 +1,27 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/scottshuffler/go-cache-plugin/lib/gcsutil"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// NewGCSBackend returns a [Backend] that stores objects in a Google Cloud
+// Storage bucket via its S3-compatible XML API, authenticating with cfg. It
+// applies the compatibility workarounds in [gcsutil] for the request-signing
+// and trailing-checksum behavior GCS doesn't support, so callers don't have
+// to wire those up themselves.
+func NewGCSBackend(cfg aws.Config, bucket, keyPrefix string) *S3Backend {
+	cli := s3.NewFromConfig(cfg,
+		func(o *s3.Options) { gcsutil.IgnoreSigningHeaders(o, []string{"Accept-Encoding"}) },
+		gcsutil.DisableTrailingChecksumForGCS,
+	)
+	return &S3Backend{
+		Client:    &s3util.Client{Client: cli, Bucket: bucket},
+		KeyPrefix: keyPrefix,
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// S3Backend is the default [Backend], storing objects in an S3 bucket via
+// [s3util.Client].
+type S3Backend struct {
+	// Client is the S3 client used to read and write cache entries. It must
+	// be non-nil.
+	Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each object key, with an
+	// intervening slash.
+	KeyPrefix string
+}
+
+func (b *S3Backend) Get(ctx context.Context, hash string) ([]byte, error) {
+	return b.Client.GetData(ctx, b.key(hash))
+}
+
+func (b *S3Backend) Put(ctx context.Context, hash string, data []byte) error {
+	return b.Client.Put(ctx, b.key(hash), bytes.NewReader(data))
+}
+
+func (b *S3Backend) Stat(ctx context.Context, hash string) (bool, error) {
+	key := b.key(hash)
+	_, err := b.Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &b.Client.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if s3util.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, hash string) error {
+	key := b.key(hash)
+	_, err := b.Client.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.Client.Bucket,
+		Key:    &key,
+	})
+	return err
+}
+
+func (b *S3Backend) key(hash string) string { return objectKey(b.KeyPrefix, hash) }
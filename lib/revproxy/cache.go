@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/scheddle"
+	"github.com/creachadair/taskgroup"
+)
+
+// cacheLoadLocal reads cached headers and body from the local cache, using
+// the Vary header recorded for hash (if any) to select the variant matching
+// r's headers.
+func (s *Server) cacheLoadLocal(hash string, r *http.Request) ([]byte, http.Header, error) {
+	dir := s.makePath(hash)
+	vary, err := os.ReadFile(filepath.Join(dir, varyIndexFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := varyDigest(varyNames(string(vary)), r.Header)
+	data, err := os.ReadFile(filepath.Join(dir, digest))
+	if err != nil {
+		return nil, nil, err
+	}
+	s.noteLocalHit(localKey(hash, digest))
+	return parseCacheObject(data)
+}
+
+// cacheStoreLocal writes the contents of body to the local cache, under the
+// variant selected by hdr's Vary header (if any) and r's headers. It is the
+// caller's responsibility not to call this for a response whose Vary header
+// is "*"; see [varyAll].
+//
+// The file format is a plain-text section at the top recording a subset of the
+// response headers, followed by "\n\n", followed by the response body.
+func (s *Server) cacheStoreLocal(hash string, r *http.Request, hdr http.Header, body []byte) error {
+	dir := s.makePath(hash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	vary := hdr.Get("Vary")
+	if err := atomicfile.Tx(filepath.Join(dir, varyIndexFile), 0644, func(f *atomicfile.File) error {
+		_, err := fmt.Fprint(f, vary)
+		return err
+	}); err != nil {
+		return err
+	}
+	digest := varyDigest(varyNames(vary), r.Header)
+	if err := atomicfile.Tx(filepath.Join(dir, digest), 0644, func(f *atomicfile.File) error {
+		return writeCacheObject(f, hdr, body)
+	}); err != nil {
+		return err
+	}
+	s.touchLocal(localKey(hash, digest), int64(len(body)))
+	return nil
+}
+
+// cacheLoadRemote reads cached headers and body from the remote tier, using
+// the Vary header recorded for hash (if any) to select the variant matching
+// r's headers.
+func (s *Server) cacheLoadRemote(ctx context.Context, hash string, r *http.Request) ([]byte, http.Header, error) {
+	vary, err := s.Backend.Get(ctx, remoteKey(hash, varyIndexFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := varyDigest(varyNames(string(vary)), r.Header)
+	data, err := s.Backend.Get(ctx, remoteKey(hash, digest))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseCacheObject(data)
+}
+
+// cacheStoreRemote returns a task that writes the contents of body, along
+// with the Vary header recorded for hash, to the remote tier.
+func (s *Server) cacheStoreRemote(hash string, r *http.Request, hdr http.Header, body []byte) taskgroup.Task {
+	var buf bytes.Buffer
+	writeCacheObject(&buf, hdr, body)
+	data := buf.Bytes()
+	vary := hdr.Get("Vary")
+	digest := remoteKey(hash, varyDigest(varyNames(vary), r.Header))
+	return func() error {
+		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer cancel()
+
+		if err := s.Backend.Put(sctx, remoteKey(hash, varyIndexFile), []byte(vary)); err != nil {
+			s.logf("[remote] put %q vary index failed: %v", hash, err)
+		}
+		if err := s.Backend.Put(sctx, digest, data); err != nil {
+			s.logf("[remote] put %q failed: %v", hash, err)
+			s.rspRemoteError.Add(1)
+		} else {
+			s.rspRemoteSave.Add(1)
+			s.rspRemoteBytes.Add(int64(len(data)))
+		}
+		return nil
+	}
+}
+
+// remoteKey joins hash and suffix into a single remote tier key, so the
+// [Backend] shards variants and the Vary index for hash under the same
+// prefix it would use for hash alone.
+func remoteKey(hash, suffix string) string { return hash + "/" + suffix }
+
+// cacheLoadMemory reads cached headers and body from the memory cache.
+func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
+	e, ok := s.mcache.Get(hash)
+	if !ok {
+		return nil, nil, fs.ErrNotExist
+	}
+	return e.body, e.header, nil
+}
+
+// cacheStoreMemory writes the contents of body to the memory cache.
+func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte) {
+	s.mcache.Put(hash, memCacheEntry{
+		header: trimCacheHeader(hdr),
+		body:   body,
+	})
+	s.expire.After(maxAge, scheddle.Run(func() {
+		s.mcache.Remove(hash)
+	}))
+}
+
+var keepHeader = []string{
+	"Cache-Control", "Content-Encoding", "Content-Type", "Date", "Etag",
+	"Last-Modified", "Vary",
+}
+
+func trimCacheHeader(h http.Header) http.Header {
+	out := make(http.Header)
+	for _, name := range keepHeader {
+		if v := h.Get(name); v != "" {
+			out.Set(name, v)
+		}
+	}
+	return out
+}
+
+// parseCacheObject parses cached object data to extract the body and headers.
+func parseCacheObject(data []byte) ([]byte, http.Header, error) {
+	hdr, rest, ok := bytes.Cut(data, []byte("\n\n"))
+	if !ok {
+		return nil, nil, errors.New("invalid cache object: missing header")
+	}
+	h := make(http.Header)
+	for _, line := range strings.Split(string(hdr), "\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if ok {
+			h.Add(name, value)
+		}
+	}
+	return rest, h, nil
+}
+
+// writeCacheObject writes the specified response data into a cache object at w.
+func writeCacheObject(w io.Writer, h http.Header, body []byte) error {
+	hprintf(w, h, "Content-Type", "application/octet-stream")
+	hprintf(w, h, "Content-Encoding", "")
+	hprintf(w, h, "Cache-Control", "")
+	hprintf(w, h, "Date", "")
+	hprintf(w, h, "Etag", "")
+	hprintf(w, h, "Last-Modified", "")
+	hprintf(w, h, "Vary", "")
+	fmt.Fprint(w, "\n")
+	_, err := w.Write(body)
+	return err
+}
+
+func hprintf(w io.Writer, h http.Header, name, fallback string) {
+	if v := h.Get(name); v != "" {
+		fmt.Fprintf(w, "%s: %s\n", name, v)
+	} else if fallback != "" {
+		fmt.Fprintf(w, "%s: %s\n", name, fallback)
+	}
+}
+
+// setXCacheInfo adds cache-specific headers to h. The effective cache mode is
+// appended to result unless it is ModeDefault, so operators can see at a
+// glance whether a bypass or strict policy shaped the outcome.
+func setXCacheInfo(h http.Header, result, hash string, mode CacheMode) {
+	if mode != ModeDefault {
+		result += "; mode=" + mode.String()
+	}
+	h.Set("X-Cache", result)
+	if hash != "" {
+		h.Set("X-Cache-Id", hash[:12])
+	}
+}
+
+// memCacheEntry is the format of entries in the memory cache.
+type memCacheEntry struct {
+	header http.Header
+	body   []byte
+}
+
+func entrySize(e memCacheEntry) int64 { return int64(len(e.body)) }
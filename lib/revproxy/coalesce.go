@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// inflight represents a fetch from the origin server that is either in
+// progress or has just completed, shared by any requests for the same hash
+// that arrive while it is running.
+type inflight struct {
+	wg        sync.WaitGroup
+	reqHeader http.Header // the leader's request headers, for Vary compatibility checks
+	status    int
+	header    http.Header
+	body      []byte
+}
+
+// coalesceFetch performs (or waits for) a single upstream fetch for hash. If
+// another request for the same hash is already in flight, it waits for that
+// fetch to complete and, provided the response's Vary header guarantees r
+// would have received the same variant, returns the shared result with
+// leader set to false. If no fetch is in flight, or the one that was doesn't
+// cover r under Vary, it performs its own fetch and returns leader set to
+// true.
+func (s *Server) coalesceFetch(hash string, r *http.Request, mode CacheMode, start time.Time) (_ *inflight, leader bool) {
+	s.mu.Lock()
+	if fl, ok := s.inflights[hash]; ok {
+		s.mu.Unlock()
+		fl.wg.Wait()
+		if varyCompatible(fl.header, fl.reqHeader, r.Header) {
+			return fl, false
+		}
+		// r isn't guaranteed to match the variant the leader fetched, so it
+		// can't safely be served the leader's buffered response; fetch it
+		// independently instead of coalescing.
+		status, header, body := s.fetchAndCache(r, hash, mode, start)
+		return &inflight{status: status, header: header, body: body}, true
+	}
+	fl := &inflight{reqHeader: r.Header.Clone()}
+	fl.wg.Add(1)
+	s.inflights[hash] = fl
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.inflights, hash)
+		s.mu.Unlock()
+		fl.wg.Done()
+	}()
+
+	fl.status, fl.header, fl.body = s.fetchAndCache(r, hash, mode, start)
+	return fl, true
+}
+
+// fetchAndCache forwards r to the origin, buffering the full response, and
+// stores it in the memory cache, or the local cache and remote tier, as the
+// response's cacheability allows. It returns
+// the response status, headers, and body so the caller (and any requests
+// coalesced onto it) can replay them.
+func (s *Server) fetchAndCache(r *http.Request, hash string, mode CacheMode, start time.Time) (int, http.Header, []byte) {
+	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
+	updateCache := func() {}
+	proxy.ModifyResponse = func(rsp *http.Response) error {
+		maxAge, isVolatile := s.canMemoryCache(rsp, mode)
+		canCacheResponse := s.canCacheResponse(rsp, mode)
+		if !canCacheResponse && !isVolatile {
+			// A response we cannot cache at all.
+			setXCacheInfo(rsp.Header, "fetch, uncached", "", mode)
+			s.rspNotCached.Add(1)
+			s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
+			return nil
+		}
+
+		// Read out the whole response body so we can update the cache, and
+		// replace the response reader so we can copy it back to the caller.
+		var buf bytes.Buffer
+		rsp.Body = copyReader{
+			Reader: io.TeeReader(rsp.Body, &buf),
+			Closer: rsp.Body,
+		}
+		if !canCacheResponse && isVolatile {
+			// A volatile response we can cache temporarily.
+			setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash, mode)
+			updateCache = func() {
+				body := buf.Bytes()
+				s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
+				s.rspSaveMem.Add(1)
+
+				// N.B. Don't persist on disk or in the remote tier.
+				s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
+			}
+		} else {
+			setXCacheInfo(rsp.Header, "fetch, cached", hash, mode)
+			updateCache = func() {
+				body := buf.Bytes()
+				if err := s.cacheStoreLocal(hash, r, rsp.Header, body); err != nil {
+					s.rspSaveError.Add(1)
+					s.logf("save %q to cache: %v", hash, err)
+
+					// N.B.: Don't bother trying to forward to the remote tier
+					// in this case.
+				} else {
+					s.rspSave.Add(1)
+					s.rspSaveBytes.Add(int64(len(body)))
+					s.start(s.cacheStoreRemote(hash, r, rsp.Header, body))
+				}
+				s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
+			}
+		}
+		return nil
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, r)
+	updateCache()
+	return rec.Code, rec.Header().Clone(), rec.Body.Bytes()
+}
+
+// writeRecordedResponse writes a buffered upstream response, as captured by
+// fetchAndCache, to w.
+func writeRecordedResponse(w http.ResponseWriter, status int, hdr http.Header, body []byte) {
+	wh := w.Header()
+	for name, vals := range hdr {
+		for _, val := range vals {
+			wh.Add(name, val)
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+// CacheMode selects how strictly a [Server] honors Cache-Control directives
+// from requests and responses for a given target.
+type CacheMode int
+
+const (
+	// ModeDefault honors request and response Cache-Control directives as
+	// described in the [Server] doc comment. This is the zero value.
+	ModeDefault CacheMode = iota
+
+	// ModeBypass never consults or stores the cache; requests are forwarded
+	// to the origin straight through.
+	ModeBypass
+
+	// ModeBypassRequest ignores request Cache-Control directives such as
+	// no-store and no-cache, and still attempts a cache lookup.
+	ModeBypassRequest
+
+	// ModeBypassResponse ignores response Cache-Control directives and
+	// caches any response whose status code is cacheable, except one whose
+	// Vary header is "*".
+	ModeBypassResponse
+
+	// ModeStrict honors every directive strictly, refusing to cache
+	// anything that doesn't carry an explicit immutable or long max-age,
+	// even if it would otherwise qualify under stale-while-revalidate or
+	// stale-if-error.
+	ModeStrict
+)
+
+// String returns the canonical name of m, as used in configuration and in
+// the X-Cache header.
+func (m CacheMode) String() string {
+	switch m {
+	case ModeBypass:
+		return "bypass"
+	case ModeBypassRequest:
+		return "bypass_request"
+	case ModeBypassResponse:
+		return "bypass_response"
+	case ModeStrict:
+		return "strict"
+	default:
+		return "default"
+	}
+}
+
+// modeFor returns the effective cache mode for host, which is s.TargetModes[host]
+// if set, or else s.Mode.
+func (s *Server) modeFor(host string) CacheMode {
+	if m, ok := s.TargetModes[host]; ok {
+		return m
+	}
+	return s.Mode
+}
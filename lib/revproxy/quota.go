@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/creachadair/mds/cache"
+)
+
+// localKey returns the key used to track hash's on-disk variant digest in
+// s.lcache, relative to s.Local.
+func localKey(hash, digest string) string { return filepath.Join(hash[:2], hash, digest) }
+
+// newLocalCache constructs the size-tracking LRU index for the on-disk
+// cache, or nil if s.MaxLocalBytes is not set, in which case the local
+// cache is unbounded. The index is seeded from whatever is already on disk
+// in s.Local, so a restart doesn't forget about existing entries and let
+// disk usage grow unbounded; entries are loaded oldest-modified first, so
+// the reconstructed recency order approximates the real one.
+func (s *Server) newLocalCache() *cache.Cache[string, int64] {
+	if s.MaxLocalBytes <= 0 {
+		return nil
+	}
+	c := cache.New(cache.LRU[string, int64](s.MaxLocalBytes).
+		WithSize(func(n int64) int64 { return n }).
+		OnEvict(s.evictLocal),
+	)
+	for _, e := range scanLocalCache(s.Local) {
+		c.Put(e.key, e.size)
+	}
+	return c
+}
+
+// localCacheEntry is a variant file discovered by [scanLocalCache].
+type localCacheEntry struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// scanLocalCache walks dir for existing on-disk cache variants, returning
+// them ordered oldest-modified first. It skips the [varyIndexFile]
+// sentinels, since only variant bodies count against MaxLocalBytes.
+func scanLocalCache(dir string) []localCacheEntry {
+	var entries []localCacheEntry
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == varyIndexFile {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		key, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, localCacheEntry{key: key, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	return entries
+}
+
+// touchLocal records a write of size bytes to the on-disk variant named by
+// key, evicting older entries off the request path if this pushes the
+// cache over its configured MaxLocalBytes.
+//
+// [cache.Cache.Put] invokes its eviction callback both for entries evicted
+// to make room and for an existing key's value when it is replaced in
+// place (as happens here whenever a revalidation rewrites an already-cached
+// variant). Only the former should delete a file, since in the latter case
+// the file at key has already been rewritten with the new contents. We mark
+// key while the Put that may replace it is in flight so evictLocal can tell
+// the two apart.
+func (s *Server) touchLocal(key string, size int64) {
+	if s.lcache == nil {
+		return
+	}
+	s.storingMu.Lock()
+	s.storing[key] = true
+	s.storingMu.Unlock()
+
+	s.lcache.Put(key, size)
+
+	s.storingMu.Lock()
+	delete(s.storing, key)
+	s.storingMu.Unlock()
+}
+
+// noteLocalHit marks key as recently used, so it is not the next entry
+// evicted under MaxLocalBytes.
+func (s *Server) noteLocalHit(key string) {
+	if s.lcache != nil {
+		s.lcache.Get(key)
+	}
+}
+
+// evictLocal is the [cache.Cache] eviction callback for s.lcache. It
+// removes the evicted variant's file off the request path, via s.tasks,
+// unless key is just being overwritten in place by the [touchLocal] call
+// that triggered this eviction; see its comment for why that case must be
+// skipped.
+func (s *Server) evictLocal(key string, _ int64) {
+	s.storingMu.Lock()
+	overwriting := s.storing[key]
+	s.storingMu.Unlock()
+	if overwriting {
+		return
+	}
+	s.start(func() error {
+		if err := os.Remove(filepath.Join(s.Local, key)); err != nil && !os.IsNotExist(err) {
+			s.logf("evict %q: %v", key, err)
+		}
+		s.localEvictions.Add(1)
+		return nil
+	})
+}
@@ -0,0 +1,221 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// revalidateClient is used to issue conditional requests to origin servers
+// when revalidating an expired cache entry. It is deliberately separate from
+// the [httputil.ReverseProxy] used for the main request path, since
+// revalidation requests are not tied to the lifetime of an inbound request.
+var revalidateClient = &http.Client{Timeout: 30 * time.Second}
+
+// freshness classifies a cached object relative to the current time, as
+// determined by its stored Date header and the Cache-Control directives that
+// were in effect when it was stored.
+type freshness int
+
+const (
+	fresh              freshness = iota // within max-age
+	staleRevalidatable                  // past max-age, within stale-while-revalidate
+	staleOnError                        // past max-age (and any swr), within stale-if-error
+	expired                             // none of the above apply
+)
+
+// bypassResponseTTL is the default freshness window applied under
+// [ModeBypassResponse] to a cached object whose origin gave no usable
+// max-age. Without it, such an object would classify as expired
+// immediately, and since it also lacks a validator to revalidate with,
+// every request would force a full re-fetch — defeating the point of
+// force-caching an overly conservative origin.
+const bypassResponseTTL = 5 * time.Minute
+
+// classifyFreshness reports the freshness of a cached object whose stored
+// response headers are hdr, as served under mode.
+func classifyFreshness(hdr http.Header, mode CacheMode) (freshness, cacheControl) {
+	cc := parseCacheControl(hdr.Get("Cache-Control"))
+	if mode == ModeBypassResponse && cc.MaxAge == 0 && !cc.Keys.Has("immutable") {
+		cc.MaxAge = bypassResponseTTL
+	}
+	age := ageOf(hdr)
+	switch {
+	case cc.Keys.Has("immutable"):
+		return fresh, cc
+	case age < cc.MaxAge:
+		return fresh, cc
+	case cc.StaleWhileRevalidate > 0 && age < cc.MaxAge+cc.StaleWhileRevalidate:
+		return staleRevalidatable, cc
+	case cc.StaleIfError > 0 && age < cc.MaxAge+cc.StaleIfError:
+		return staleOnError, cc
+	default:
+		return expired, cc
+	}
+}
+
+// ageOf reports how long ago hdr's Date header was, or zero if hdr has no
+// usable Date header.
+func ageOf(hdr http.Header) time.Duration {
+	t, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	return time.Since(t)
+}
+
+// targetURL resolves the fully-qualified origin URL for the proxied request
+// r, whose URL carries only a path and query; the target host travels in the
+// Host header, per the convention used by [Server.rewriteRequest].
+func targetURL(r *http.Request) (*url.URL, error) {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = r.Host
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// revalidateRequest issues a conditional GET for u, using the validators
+// recorded in hdr (ETag and Last-Modified), and returns the origin's
+// response.
+func revalidateRequest(ctx context.Context, u *url.URL, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag := hdr.Get("Etag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := hdr.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+	return revalidateClient.Do(req)
+}
+
+// revalidateSync performs a synchronous conditional request for an object
+// whose cached copy has fully expired (including any stale-while-revalidate
+// grace period). If the origin confirms the cached copy is still valid (304
+// Not Modified), it returns updated headers and true. If the request to the
+// origin fails and the cached copy is still eligible under stale-if-error, it
+// returns the original headers and true, with the body served as-is by the
+// caller. Otherwise it returns false, and the caller should fall through to a
+// normal fetch.
+func (s *Server) revalidateSync(ctx context.Context, hash string, hdr http.Header, body []byte, cc cacheControl, r *http.Request) (http.Header, bool) {
+	if !hasValidator(hdr) {
+		// No Etag or Last-Modified to revalidate with, so a conditional
+		// request can never come back 304; don't bother making one.
+		return nil, false
+	}
+	u, err := targetURL(r)
+	if err != nil {
+		return nil, false
+	}
+	rsp, err := revalidateRequest(ctx, u, hdr)
+	if err != nil {
+		if cc.StaleIfError > 0 && ageOf(hdr) < cc.MaxAge+cc.StaleIfError {
+			s.logf("[revalidate] %q: origin unreachable, serving stale: %v", hash, err)
+			return hdr, true
+		}
+		return nil, false
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotModified {
+		return nil, false
+	}
+	nhdr := hdr.Clone()
+	copyValidators(nhdr, rsp.Header)
+	if err := s.cacheStoreLocal(hash, r, nhdr, body); err != nil {
+		s.logf("[revalidate] %q: update local cache: %v", hash, err)
+	}
+	return nhdr, true
+}
+
+// revalidateTask returns a task that asynchronously revalidates the cache
+// entry for hash while its stale copy is still being served to callers. On a
+// 304 response it refreshes the stored headers; on a full 200 response it
+// replaces the cached body, unless the new response's Vary header is "*"; on
+// failure it leaves the stale entry in place for stale-if-error to keep
+// covering subsequent requests.
+func (s *Server) revalidateTask(hash string, hdr http.Header, body []byte, r *http.Request) taskgroup.Task {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer cancel()
+
+		u, err := targetURL(r)
+		if err != nil {
+			s.revalidateError.Add(1)
+			return nil
+		}
+		rsp, err := revalidateRequest(ctx, u, hdr)
+		if err != nil {
+			s.revalidateError.Add(1)
+			s.logf("[revalidate] %q: background revalidation failed: %v", hash, err)
+			return nil
+		}
+		defer rsp.Body.Close()
+
+		switch rsp.StatusCode {
+		case http.StatusNotModified:
+			nhdr := hdr.Clone()
+			copyValidators(nhdr, rsp.Header)
+			if err := s.cacheStoreLocal(hash, r, nhdr, body); err != nil {
+				s.revalidateError.Add(1)
+				s.logf("[revalidate] %q: update local cache: %v", hash, err)
+				return nil
+			}
+			s.start(s.cacheStoreRemote(hash, r, nhdr, body))
+		case http.StatusOK:
+			if varyAll(rsp.Header.Get("Vary")) {
+				// Not cacheable; see [Server.cacheStoreLocal].
+				return nil
+			}
+			newBody, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				s.revalidateError.Add(1)
+				s.logf("[revalidate] %q: read refreshed body: %v", hash, err)
+				return nil
+			}
+			if err := s.cacheStoreLocal(hash, r, rsp.Header, newBody); err != nil {
+				s.revalidateError.Add(1)
+				s.logf("[revalidate] %q: store refreshed body: %v", hash, err)
+				return nil
+			}
+			s.start(s.cacheStoreRemote(hash, r, rsp.Header, newBody))
+		default:
+			// Leave the stale entry as-is; it remains eligible under
+			// stale-if-error until it ages out entirely.
+			s.revalidateError.Add(1)
+			return nil
+		}
+		s.revalidateOK.Add(1)
+		return nil
+	}
+}
+
+// copyValidators updates dst's cache validators and Date from a 304 response
+// header src, per RFC 7232 §4.1.
+func copyValidators(dst, src http.Header) {
+	if v := src.Get("Date"); v != "" {
+		dst.Set("Date", v)
+	}
+	if v := src.Get("Etag"); v != "" {
+		dst.Set("Etag", v)
+	}
+	if v := src.Get("Last-Modified"); v != "" {
+		dst.Set("Last-Modified", v)
+	}
+	if v := src.Get("Cache-Control"); v != "" {
+		dst.Set("Cache-Control", v)
+	}
+}
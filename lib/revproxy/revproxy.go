@@ -2,19 +2,23 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package revproxy implements a minimal HTTP reverse proxy that caches files
-// locally on disk, backed by objects in an S3 bucket.
+// locally on disk, backed by objects in a pluggable remote [Backend].
 //
 // # Limitations
 //
 // By default, only objects marked "immutable" by the target server are
-// eligible to be cached. Volatile objects that specify a max-age are also
-// cached in-memory, but are not persisted on disk or in S3. If we think it's
-// worthwhile we can spend some time to add more elaborate cache pruning, but
-// for now we're doing the simpler thing.
+// eligible to be cached unconditionally. Volatile objects that specify a
+// max-age are also cached in-memory, but are not persisted on disk or in the
+// remote tier. Objects that carry a validator (ETag or Last-Modified) and
+// advertise stale-while-revalidate or stale-if-error (RFC 5861) are
+// persisted on disk and in the remote tier as well, and are revalidated with
+// a conditional request once their max-age has elapsed rather than being
+// refetched outright. The local disk cache is pruned only when
+// [Server.MaxLocalBytes] is set, by evicting least-recently-used variants;
+// objects in the remote tier are never pruned.
 package revproxy
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"expvar"
 	"fmt"
@@ -22,7 +26,6 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
@@ -35,7 +38,6 @@ import (
 	"github.com/creachadair/mds/mapset"
 	"github.com/creachadair/scheddle"
 	"github.com/creachadair/taskgroup"
-	"github.com/tailscale/go-cache-plugin/lib/s3util"
 )
 
 // Server is a caching reverse proxy server that caches successful responses to
@@ -49,11 +51,21 @@ import (
 // In addition, a successful response that is not immutable and specifies a
 // max-age will be cached temporarily in-memory.
 //
+// This policy can be relaxed or tightened with Mode and TargetModes; see
+// [CacheMode] for the available options. The effective mode, if not
+// [ModeDefault], is reported in the "X-Cache" header.
+//
 // # Cache Format
 //
 // A cached response is a file with a header section and the body, separated by
 // a blank line. Only a subset of response headers are saved.
 //
+// Each cache entry is a directory holding a sentinel that records the
+// response's Vary header (empty if it has none), plus one such file per
+// distinct combination of values for the header names Vary lists; without a
+// Vary header there is a single file. A response whose Vary header is "*" is
+// never cached, since it can't be matched against a later request.
+//
 // # Cache Responses
 //
 // For requests handled by the proxy, the response includes an "X-Cache" header
@@ -61,9 +73,20 @@ import (
 //
 //   - "hit, memory": The response was served out of the memory cache.
 //   - "hit, local": The response was served out of the local cache.
-//   - "hit, remote": The response was faulted in from S3.
+//   - "hit, remote": The response was faulted in from the remote tier.
+//   - "hit, stale": The response was expired but within stale-while-revalidate,
+//     so the stale copy was served while a conditional request to the origin
+//     happened out of band.
+//   - "hit, revalidated": The response had expired, but a synchronous
+//     conditional request confirmed the cached copy is still current. The
+//     same value is reported when that request could not reach the origin
+//     and the copy was served under stale-if-error.
+//   - "hit, coalesced": The response was shared from a concurrent fetch of
+//     the same object made on behalf of another request.
 //   - "fetch, cached": The response was forwarded to the target and cached.
 //   - "fetch, uncached": The response was forwarded to the target and not cached.
+//   - "bypass": The request was forwarded without consulting or updating the
+//     cache at all, because the effective mode is [ModeBypass].
 //
 // For results intersecting with the cache, it also reports a X-Cache-Id giving
 // the storage key of the cache object.
@@ -76,13 +99,24 @@ type Server struct {
 	// It must be non-empty.
 	Local string
 
-	// S3Client is the S3 client used to read and write cache entries to the
-	// backing store. It must be non-nil
-	S3Client *s3util.Client
+	// Backend is the remote storage tier used to read and write cache entries
+	// that don't fit in, or don't survive a restart of, the local cache. It
+	// must be non-nil; use [NoRemoteBackend] for a Server with no remote tier.
+	Backend Backend
+
+	// Mode selects the cache-control enforcement policy applied to targets
+	// that aren't overridden in TargetModes. The zero value is ModeDefault.
+	Mode CacheMode
 
-	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
-	// intervening slash.
-	KeyPrefix string
+	// TargetModes, if non-nil, overrides Mode for specific hosts (as listed
+	// in Targets).
+	TargetModes map[string]CacheMode
+
+	// MaxLocalBytes, if positive, bounds the total size of response bodies
+	// kept in the local cache. Once the bound is reached, the
+	// least-recently-used variants are evicted off the request path to make
+	// room. If zero, the local cache is unbounded.
+	MaxLocalBytes int64
 
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
@@ -107,15 +141,18 @@ type Server struct {
 	//
 	// The dispositions of a request are:
 	//
-	//     hit mem  -- cache hit in memory (volatile)
-	//     hit disk -- cache hit in local disk
-	//     hit S3   -- cache hit in S3 (faulted to disk)
-	//     fetch    -- fetched from the origin server
+	//     hit mem         -- cache hit in memory (volatile)
+	//     hit disk        -- cache hit in local disk
+	//     hit stale       -- stale hit in local disk, revalidated in the background
+	//     hit revalidated -- expired hit in local disk, revalidated synchronously
+	//     hit remote      -- cache hit in the remote tier (faulted to disk)
+	//     hit coalesced   -- shared from a concurrent fetch of the same object
+	//     fetch           -- fetched from the origin server
 	//
 	// On fetches, the "RC" tag indicates whether the response is cacheable,
 	// with "no" meaning it was not cached at all, "mem" meaning it was cached
 	// as a short-lived volatile response in memory, and "yes" meaning it was
-	// cached on disk (and S3).
+	// cached on disk (and in the remote tier).
 	LogRequests bool
 
 	initOnce sync.Once
@@ -123,22 +160,35 @@ type Server struct {
 	start    func(taskgroup.Task)
 	mcache   *cache.Cache[string, memCacheEntry] // short-lived mutable objects
 	expire   *scheddle.Queue                     // cache expirations
-
-	reqReceived  expvar.Int // total requests received
-	reqMemoryHit expvar.Int // hit in memory cache (volatile)
-	reqLocalHit  expvar.Int // hit in local cache
-	reqLocalMiss expvar.Int // miss in local cache
-	reqFaultHit  expvar.Int // hit in remote (S3) cache
-	reqFaultMiss expvar.Int // miss in remote (S3) cache
-	reqForward   expvar.Int // request forwarded directly to upstream
-	rspSave      expvar.Int // successful response saved in local cache
-	rspSaveMem   expvar.Int // response saved in memory cache
-	rspSaveError expvar.Int // error saving to local cache
-	rspSaveBytes expvar.Int // bytes written to local cache
-	rspPush      expvar.Int // successful response saved in S3
-	rspPushError expvar.Int // error saving to S3
-	rspPushBytes expvar.Int // bytes written to S3
-	rspNotCached expvar.Int // response not cached anywhere
+	lcache   *cache.Cache[string, int64]         // local cache size/LRU index; nil if unbounded
+
+	mu        sync.Mutex           // guards inflights
+	inflights map[string]*inflight // in-progress upstream fetches, by hash
+
+	storingMu sync.Mutex      // guards storing
+	storing   map[string]bool // local cache keys mid-overwrite, so evictLocal can tell a replace from a real eviction
+
+	reqReceived     expvar.Int // total requests received
+	reqMemoryHit    expvar.Int // hit in memory cache (volatile)
+	reqLocalHit     expvar.Int // hit in local cache
+	reqLocalMiss    expvar.Int // miss in local cache
+	reqRemoteHit    expvar.Int // hit in the remote tier
+	reqRemoteMiss   expvar.Int // miss in the remote tier
+	reqStaleHit     expvar.Int // stale hit served under stale-while-revalidate
+	reqRevalidated  expvar.Int // expired hit confirmed fresh by synchronous revalidation, or served under stale-if-error
+	reqCoalesced    expvar.Int // miss served from a concurrent in-flight fetch for the same hash
+	reqForward      expvar.Int // request forwarded directly to upstream
+	rspSave         expvar.Int // successful response saved in local cache
+	rspSaveMem      expvar.Int // response saved in memory cache
+	rspSaveError    expvar.Int // error saving to local cache
+	rspSaveBytes    expvar.Int // bytes written to local cache
+	rspRemoteSave   expvar.Int // successful response saved in the remote tier
+	rspRemoteError  expvar.Int // error saving to the remote tier
+	rspRemoteBytes  expvar.Int // bytes written to the remote tier
+	rspNotCached    expvar.Int // response not cached anywhere
+	revalidateOK    expvar.Int // background revalidation completed (304 or 200)
+	revalidateError expvar.Int // background revalidation failed
+	localEvictions  expvar.Int // local cache entries evicted to stay under MaxLocalBytes
 }
 
 func (s *Server) init() {
@@ -149,6 +199,9 @@ func (s *Server) init() {
 			WithSize(entrySize),
 		)
 		s.expire = scheddle.NewQueue(nil)
+		s.inflights = make(map[string]*inflight)
+		s.storing = make(map[string]bool)
+		s.lcache = s.newLocalCache()
 	})
 }
 
@@ -160,17 +213,35 @@ func (s *Server) Metrics() *expvar.Map {
 	m.Set("req_memory_hit", &s.reqMemoryHit)
 	m.Set("req_local_hit", &s.reqLocalHit)
 	m.Set("req_local_miss", &s.reqLocalMiss)
-	m.Set("req_fault_hit", &s.reqFaultHit)
-	m.Set("req_fault_miss", &s.reqFaultMiss)
+	m.Set("req_remote_hit", &s.reqRemoteHit)
+	m.Set("req_remote_miss", &s.reqRemoteMiss)
+	m.Set("req_stale_hit", &s.reqStaleHit)
+	m.Set("req_revalidated", &s.reqRevalidated)
+	m.Set("req_coalesced", &s.reqCoalesced)
 	m.Set("req_forward", &s.reqForward)
 	m.Set("rsp_save", &s.rspSave)
 	m.Set("rsp_save_memory", &s.rspSaveMem)
 	m.Set("rsp_save_error", &s.rspSaveError)
 	m.Set("rsp_save_bytes", &s.rspSaveBytes)
-	m.Set("rsp_push", &s.rspPush)
-	m.Set("rsp_push_error", &s.rspPushError)
-	m.Set("rsp_push_bytes", &s.rspPushBytes)
+	m.Set("rsp_remote_save", &s.rspRemoteSave)
+	m.Set("rsp_remote_save_error", &s.rspRemoteError)
+	m.Set("rsp_remote_save_bytes", &s.rspRemoteBytes)
 	m.Set("rsp_not_cached", &s.rspNotCached)
+	m.Set("revalidate_ok", &s.revalidateOK)
+	m.Set("revalidate_error", &s.revalidateError)
+	m.Set("local_bytes_used", expvar.Func(func() any {
+		if s.lcache == nil {
+			return int64(0)
+		}
+		return s.lcache.Size()
+	}))
+	m.Set("local_entries", expvar.Func(func() any {
+		if s.lcache == nil {
+			return 0
+		}
+		return s.lcache.Len()
+	}))
+	m.Set("local_evictions", &s.localEvictions)
 	return m
 }
 
@@ -187,103 +258,107 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hash := hashRequestURL(r.URL)
-	canCache := s.canCacheRequest(r)
-	s.vlogf("rp B U:%q H:%s C:%v", r.URL, hash, canCache)
+	mode := s.modeFor(r.Host)
+	canCache := s.canCacheRequest(r, mode)
+	s.vlogf("rp B U:%q H:%s C:%v M:%s", r.URL, hash, canCache, mode)
 	start := time.Now()
 	if canCache {
 		// Check for a hit on this object in the memory cache.
 		if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
 			s.reqMemoryHit.Add(1)
-			setXCacheInfo(hdr, "hit, memory", hash)
+			setXCacheInfo(hdr, "hit, memory", hash, mode)
 			writeCachedResponse(w, hdr, data)
 			s.vlogf("rp E H:%s hit mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
 		}
 
 		// Check for a hit on this object in the local cache.
-		if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
-			s.reqLocalHit.Add(1)
-			setXCacheInfo(hdr, "hit, local", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
-			return
+		localExpired := false
+		if data, hdr, err := s.cacheLoadLocal(hash, r); err == nil {
+			switch state, cc := classifyFreshness(hdr, mode); state {
+			case fresh:
+				s.reqLocalHit.Add(1)
+				setXCacheInfo(hdr, "hit, local", hash, mode)
+				writeCachedResponse(w, hdr, data)
+				s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
+
+			case staleRevalidatable:
+				s.reqLocalHit.Add(1)
+				s.reqStaleHit.Add(1)
+				hdr = hdr.Clone()
+				hdr.Set("Warning", `110 - "Response is Stale"`)
+				setXCacheInfo(hdr, "hit, stale", hash, mode)
+				writeCachedResponse(w, hdr, data)
+				s.start(s.revalidateTask(hash, hdr, data, r))
+				s.vlogf("rp E H:%s hit stale B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
+
+			default: // staleOnError, expired
+				if nhdr, ok := s.revalidateSync(r.Context(), hash, hdr, data, cc, r); ok {
+					s.reqLocalHit.Add(1)
+					s.reqRevalidated.Add(1)
+					setXCacheInfo(nhdr, "hit, revalidated", hash, mode)
+					writeCachedResponse(w, nhdr, data)
+					s.vlogf("rp E H:%s hit revalidated B:%d (%v elapsed)", hash, len(data), time.Since(start))
+					return
+				}
+				// Fall through: the entry can't be served as-is, so treat this
+				// as a local miss and refetch from the origin below.
+				localExpired = true
+			}
 		}
 		s.reqLocalMiss.Add(1)
 
-		// Fault in from S3.
-		if data, hdr, err := s.cacheLoadS3(r.Context(), hash); err == nil {
-			s.reqFaultHit.Add(1)
-			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
+		// Fault in from the remote tier, unless the local copy expired above.
+		if localExpired {
+			// Skip the remote tier; the object is refetched from the origin.
+		} else if data, hdr, err := s.cacheLoadRemote(r.Context(), hash, r); err == nil {
+			s.reqRemoteHit.Add(1)
+			if err := s.cacheStoreLocal(hash, r, hdr, data); err != nil {
 				s.logf("update %q local: %v", hash, err)
 			}
-			setXCacheInfo(hdr, "hit, remote", hash)
+			setXCacheInfo(hdr, "hit, remote", hash, mode)
 			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
+			s.vlogf("rp E H:%s hit remote B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
+		} else {
+			s.reqRemoteMiss.Add(1)
 		}
-		s.reqFaultMiss.Add(1)
 		s.vlogf("rp - H:%s miss", hash)
 	}
 
 	// Reaching here, the object is not already cached locally so we have to
-	// talk to the backend to get it. We need to do this whether or not it is
-	// cacheable. Note we handle each request with its own proxy instance, so
-	// that we can handle each response in context of this request.
+	// talk to the origin server to get it. We need to do this whether or not
+	// it is cacheable.
 	s.reqForward.Add(1)
-	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
-	updateCache := func() {}
-	if canCache {
+	if !canCache {
+		// Each request handles its own uncacheable fetch with its own proxy
+		// instance, streamed directly to the caller.
+		proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
 		proxy.ModifyResponse = func(rsp *http.Response) error {
-			maxAge, isVolatile := s.canMemoryCache(rsp)
-			canCacheResponse := s.canCacheResponse(rsp)
-			if !canCacheResponse && !isVolatile {
-				// A response we cannot cache at all.
-				setXCacheInfo(rsp.Header, "fetch, uncached", "")
-				s.rspNotCached.Add(1)
-				s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
-				return nil
-			}
-
-			// Read out the whole response body so we can update the cache, and
-			// replace the response reader so we can copy it back to the caller.
-			var buf bytes.Buffer
-			rsp.Body = copyReader{
-				Reader: io.TeeReader(rsp.Body, &buf),
-				Closer: rsp.Body,
-			}
-			if !canCacheResponse && isVolatile {
-				// A volatile response we can cache temporarily.
-				setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
-				updateCache = func() {
-					body := buf.Bytes()
-					s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
-					s.rspSaveMem.Add(1)
-
-					// N.B. Don't persist on disk or in S3.
-					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
-				}
-			} else {
-				setXCacheInfo(rsp.Header, "fetch, cached", hash)
-				updateCache = func() {
-					body := buf.Bytes()
-					if err := s.cacheStoreLocal(hash, rsp.Header, body); err != nil {
-						s.rspSaveError.Add(1)
-						s.logf("save %q to cache: %v", hash, err)
-
-						// N.B.: Don't bother trying to forward to S3 in this case.
-					} else {
-						s.rspSave.Add(1)
-						s.rspSaveBytes.Add(int64(len(body)))
-						s.start(s.cacheStoreS3(hash, rsp.Header, body))
-					}
-					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
-				}
+			disposition := "fetch, uncached"
+			if mode == ModeBypass {
+				disposition = "bypass"
 			}
+			setXCacheInfo(rsp.Header, disposition, "", mode)
 			return nil
 		}
+		proxy.ServeHTTP(w, r)
+		return
 	}
-	proxy.ServeHTTP(w, r)
-	updateCache()
+
+	// Cacheable misses are coalesced: concurrent requests for the same hash
+	// share a single upstream fetch instead of each spawning their own.
+	fl, leader := s.coalesceFetch(hash, r, mode, start)
+	hdr := fl.header
+	if !leader {
+		s.reqCoalesced.Add(1)
+		hdr = hdr.Clone()
+		setXCacheInfo(hdr, "hit, coalesced", hash, mode)
+		s.vlogf("rp E H:%s hit coalesced B:%d (%v elapsed)", hash, len(fl.body), time.Since(start))
+	}
+	writeRecordedResponse(w, fl.status, hdr, fl.body)
 }
 
 // rewriteRequest rewrites the inbound request for routing to a target.
@@ -302,12 +377,11 @@ type copyReader struct {
 	io.Closer
 }
 
-// makePath returns the local cache path for the specified request hash.
+// makePath returns the local cache directory for the specified request
+// hash. It contains a [varyIndexFile] sentinel plus one file per cached
+// Vary variant, named for its variant digest.
 func (s *Server) makePath(hash string) string { return filepath.Join(s.Local, hash[:2], hash) }
 
-// makeKey returns the S3 object key for the specified request hash.
-func (s *Server) makeKey(hash string) string { return path.Join(s.KeyPrefix, hash[:2], hash) }
-
 func (s *Server) logf(msg string, args ...any) {
 	if s.Logf != nil {
 		s.Logf(msg, args...)
@@ -324,16 +398,35 @@ func hostMatchesTarget(host string, targets []string) bool {
 	return slices.Contains(targets, host)
 }
 
-// canCacheRequest reports whether r is a request whose response can be cached.
-func (s *Server) canCacheRequest(r *http.Request) bool {
-	return r.Method == "GET" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
+// canCacheRequest reports whether r is a request whose response can be
+// cached under mode.
+func (s *Server) canCacheRequest(r *http.Request, mode CacheMode) bool {
+	if mode == ModeBypass {
+		return false
+	}
+	if r.Method != "GET" {
+		return false
+	}
+	if mode == ModeBypassRequest {
+		return true
+	}
+	return !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
 }
 
-// canCacheResponse reports whether r is a response whose body can be cached.
-func (s *Server) canCacheResponse(rsp *http.Response) bool {
+// canCacheResponse reports whether r is a response whose body can be cached
+// under mode.
+func (s *Server) canCacheResponse(rsp *http.Response, mode CacheMode) bool {
 	if rsp.StatusCode != http.StatusOK {
 		return false
 	}
+	if varyAll(rsp.Header.Get("Vary")) {
+		// A response that varies on every request can never be matched
+		// against a later one, so it can't be cached under any mode.
+		return false
+	}
+	if mode == ModeBypassResponse {
+		return true
+	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
 	if cc.Keys.Has("no-store") {
 		return false
@@ -344,21 +437,53 @@ func (s *Server) canCacheResponse(rsp *http.Response) bool {
 	// We treat a response that is not immutable but requires validation as
 	// cacheable if its max-age is so long it doesn't matter.
 	const goodLongTime = 60 * 24 * time.Hour
-	return cc.Keys.Has("must-revalidate") && cc.MaxAge > goodLongTime
+	if cc.Keys.Has("must-revalidate") && cc.MaxAge > goodLongTime {
+		return true
+	}
+	if mode == ModeStrict {
+		return false
+	}
+
+	// A response that isn't immutable but both carries a validator and
+	// advertises stale-while-revalidate or stale-if-error (RFC 5861) can
+	// still be cached: once it expires we revalidate it with a conditional
+	// request instead of refusing to cache it at all.
+	if (cc.StaleWhileRevalidate > 0 || cc.StaleIfError > 0) && hasValidator(rsp.Header) {
+		return true
+	}
+	return false
+}
+
+// hasValidator reports whether h carries a validator usable for a
+// conditional (If-None-Match / If-Modified-Since) request.
+func hasValidator(h http.Header) bool {
+	return h.Get("Etag") != "" || h.Get("Last-Modified") != ""
 }
 
 type cacheControl struct {
-	Keys   mapset.Set[string]
-	MaxAge time.Duration
+	Keys                 mapset.Set[string]
+	MaxAge               time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
 }
 
 func parseCacheControl(s string) (out cacheControl) {
 	for _, v := range strings.Split(s, ",") {
 		key, val, ok := strings.Cut(strings.TrimSpace(v), "=")
-		if ok && key == "max-age" {
-			sec, err := strconv.Atoi(val)
-			if err == nil {
-				out.MaxAge = time.Duration(sec) * time.Second
+		if ok {
+			switch key {
+			case "max-age":
+				if sec, err := strconv.Atoi(val); err == nil {
+					out.MaxAge = time.Duration(sec) * time.Second
+				}
+			case "stale-while-revalidate":
+				if sec, err := strconv.Atoi(val); err == nil {
+					out.StaleWhileRevalidate = time.Duration(sec) * time.Second
+				}
+			case "stale-if-error":
+				if sec, err := strconv.Atoi(val); err == nil {
+					out.StaleIfError = time.Duration(sec) * time.Second
+				}
 			}
 		}
 		out.Keys.Add(key)
@@ -367,14 +492,17 @@ func parseCacheControl(s string) (out cacheControl) {
 }
 
 // canMemoryCache reports whether r is a volatile response whose body can be
-// cached temporarily, and if so returns the maxmimum length of time the cache
-// entry should be valid for.
-func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
-	if rsp.StatusCode != http.StatusOK {
+// cached temporarily under mode, and if so returns the maxmimum length of
+// time the cache entry should be valid for.
+func (s *Server) canMemoryCache(rsp *http.Response, mode CacheMode) (time.Duration, bool) {
+	if rsp.StatusCode != http.StatusOK || mode == ModeStrict {
+		return 0, false
+	}
+	if varyAll(rsp.Header.Get("Vary")) {
 		return 0, false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
-	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
+	if mode != ModeBypassResponse && (cc.Keys.Has("no-store") || cc.Keys.Has("no-cache")) {
 		// While no-cache doesn't mean we can't cache it, it requires
 		// re-validation before reusing the response, so treat that as if it were
 		// no-store.
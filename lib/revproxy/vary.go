@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// varyIndexFile is the name of the sentinel entry, stored alongside a hash's
+// cache variants, that records the Vary header in effect for the cached
+// response. It is never a valid variant digest, since sha256 hex digests are
+// 64 characters long.
+const varyIndexFile = "vary"
+
+// varyAll reports whether vary is the literal "*" Vary header value. Per RFC
+// 7231 §7.1.4, such a response can never be matched against a later request,
+// so it is not cacheable at all.
+func varyAll(vary string) bool {
+	return strings.TrimSpace(vary) == "*"
+}
+
+// varyNames returns the normalized (lower-cased, sorted, deduplicated) list
+// of request header names that vary selects.
+func varyNames(vary string) []string {
+	if vary == "" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, f := range strings.Split(vary, ",") {
+		name := strings.ToLower(strings.TrimSpace(f))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// varyCompatible reports whether leaderHdr and followerHdr are guaranteed to
+// select the same cache variant of a response whose headers are
+// rspHeader. This is used to decide whether a request can safely be handed
+// the buffered response from a coalesced fetch made on another request's
+// behalf.
+func varyCompatible(rspHeader, leaderHdr, followerHdr http.Header) bool {
+	vary := rspHeader.Get("Vary")
+	if varyAll(vary) {
+		return false
+	}
+	names := varyNames(vary)
+	if len(names) == 0 {
+		return true
+	}
+	return varyDigest(names, leaderHdr) == varyDigest(names, followerHdr)
+}
+
+// varyDigest computes the storage key variant for a request, given the
+// (already normalized) names of the headers a cached response for it varies
+// on.
+func varyDigest(names []string, h http.Header) string {
+	d := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(d, "%s=%s\n", name, h.Get(name))
+	}
+	return fmt.Sprintf("%x", d.Sum(nil))
+}